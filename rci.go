@@ -1,19 +1,27 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math/rand"
 	"net/http"
 	"os"
+	"os/exec"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/op/go-logging"
+	"gopkg.in/yaml.v2"
 
 	"k8s.io/kubernetes/pkg/util/jsonpath"
 )
@@ -39,19 +47,117 @@ var (
 	error_map = flag.String("r", "",
 		"response mapping; the format is `X1;X2;X3...` where Xi is\n"+
 			"CODE=MAPPING; CODE is either a numeric HTTP response code or\n"+
-			"a template `2XX`, `4XX`, `5XX`; MAPPING is either a number which\n"+
+			"a template `2XX`, `4XX`, `5XX`, or (with -graphql) `GQL` for a\n"+
+			"non-empty top-level errors[]; MAPPING is either a number which\n"+
 			"indicates a process exit code (EC) or `EC:MESSAGE_TEMPLATE` where\n"+
 			"MESSAGE_TEMPLATE is a string with {}-enclosed jsonpath expressions;\n"+
 			"the expressions follow the general syntax of Kubernetes jsonpath\n"+
 			"(http://kubernetes.io/docs/user-guide/jsonpath/) with the response\n"+
 			"JSON message being the root document")
+
+	retry_max = flag.Int("retry-max", 0,
+		"maximum number of retries on transient failures (network errors and\n"+
+			"status codes from -retry-on); 0 disables retrying")
+	retry_wait_min = flag.Duration("retry-wait-min", 500*time.Millisecond,
+		"base wait before the first retry; it doubles with each further\n"+
+			"retry up to -retry-wait-max, and jitter picks the actual wait\n"+
+			"between half of that value and the whole of it")
+	retry_wait_max = flag.Duration("retry-wait-max", 30*time.Second,
+		"maximum wait between retries")
+	retry_on = flag.String("retry-on", "429,502,503,504",
+		"comma-separated list of HTTP status codes to retry on; entries may\n"+
+			"also be a class such as `5XX`; a `Retry-After` response header, if\n"+
+			"present, overrides the computed backoff")
+	retry_timeout = flag.Duration("retry-timeout", 0,
+		"maximum total time to spend retrying; 0 means no limit other than\n"+
+			"-retry-max")
+
+	k8s_in_cluster = flag.Bool("k8s-in-cluster", false,
+		"configure the HTTP client to talk to the Kubernetes API server\n"+
+			"from within a pod: auto-detects the service-account token and CA\n"+
+			"bundle under /var/run/secrets/kubernetes.io/serviceaccount and\n"+
+			"resolves the API server from KUBERNETES_SERVICE_HOST/PORT")
+	kubeconfig = flag.String("kubeconfig", "",
+		"path to a kubeconfig file; when set, the cluster, user credentials\n"+
+			"and API server of -k8s-context (or the current context) are used\n"+
+			"to configure the HTTP client, same as -k8s-in-cluster")
+	k8s_context = flag.String("k8s-context", "",
+		"context to use from -kubeconfig; defaults to its current-context")
+
+	follow = flag.Bool("follow", false,
+		"keep the response body open and process it incrementally, one\n"+
+			"NDJSON object or text line at a time, instead of decoding the\n"+
+			"whole body once; each record is mapped through -r and printed\n"+
+			"as it arrives")
+	follow_exit_on = flag.String("follow-exit-on", "",
+		"a jsonpath predicate of the form `{.path}==VALUE`; when a streamed\n"+
+			"record matches, -follow terminates and exits with the code from\n"+
+			"the mapping selected for the response's status")
+	follow_heartbeat = flag.Duration("follow-heartbeat", 0,
+		"when set, log a heartbeat if no record arrives for this long,\n"+
+			"instead of blocking silently on the stream")
+
+	dump = flag.String("dump", "none",
+		"print the outgoing request and incoming response to stderr for\n"+
+			"debugging; one of `none`, `headers`, `body`, `all`")
+	dump_indent = flag.Int("dump-indent", 2,
+		"number of spaces to indent dumped `application/json` bodies by")
+	dump_redact = flag.String("dump-redact", "Authorization,Cookie",
+		"comma-separated list of header names to redact in -dump output")
+
+	graphql = flag.Bool("graphql", false,
+		"treat -b as a GraphQL query/mutation (or @file) and POST it to -a\n"+
+			"as `{\"query\":...,\"variables\":{...},\"operationName\":...}`;\n"+
+			"extends -r so mappings can target `GQL` for a non-empty\n"+
+			"top-level errors[] array, even on HTTP 200")
+	gql_op = flag.String("gql-op", "", "GraphQL operationName to send with -graphql")
 )
 
+var gql_vars gqlVarList
+
+func init() {
+	flag.Var(&gql_vars, "gql-var", "GraphQL variable as `name=value` (repeatable);\n"+
+		"value is parsed as JSON when possible, otherwise sent as a string")
+}
+
+// gqlVarList collects repeated -gql-var occurrences.
+type gqlVarList []string
+
+func (v *gqlVarList) String() string {
+	return strings.Join(*v, ",")
+}
+
+func (v *gqlVarList) Set(value string) error {
+	*v = append(*v, value)
+	return nil
+}
+
 var Usage = func() {
 	fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
 	flag.PrintDefaults()
 }
 
+// read_body_spec resolves a -b value: a literal string, `@file`, or `@-`
+// for standard input.
+func read_body_spec(spec string) ([]byte, error) {
+	if !strings.HasPrefix(spec, "@") {
+		return []byte(spec), nil
+	}
+
+	filename := spec[1:]
+	var text []byte
+	var err error
+	if filename == "-" {
+		text, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		text, err = ioutil.ReadFile(filename)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read file %s: %s", filename, err)
+	}
+	return text, nil
+}
+
 func main() {
 	logging.SetFormatter(format)
 
@@ -75,35 +181,93 @@ func main() {
 		os.Exit(1)
 	}
 
-	var buf io.Reader = nil
+	var body_bytes []byte = nil
 
-	if *method == "POST" || *method == "PUT" {
-		if strings.HasPrefix(*body, "@") {
-			filename := (*body)[1:len(*body)]
-			text, err := ioutil.ReadFile(filename)
-			if err != nil {
-				fmt.Printf("Cannot read file %s: %s\n", filename, err)
-				os.Exit(1)
-			}
-			buf = bytes.NewReader(text)
-		} else {
-			buf = strings.NewReader(*body)
+	if *method == "POST" || *method == "PUT" || *graphql {
+		text, err := read_body_spec(*body)
+		if err != nil {
+			fmt.Printf("%s\n", err)
+			os.Exit(1)
 		}
+		body_bytes = text
 	}
 
-	req, err := http.NewRequest(*method, *url, buf)
+	retry_cfg, err := parse_retry_config(*retry_max, *retry_wait_min, *retry_wait_max, *retry_on, *retry_timeout)
 	if err != nil {
-		fmt.Printf("Cannot create HTTP request: %s\n", err)
+		fmt.Printf("Invalid retry configuration: %s\n", err)
 		os.Exit(1)
 	}
 
 	client := &http.Client{Timeout: 60 * time.Second}
-	resp, err := client.Do(req)
+	headers := make(map[string]string)
+	target_url := *url
+
+	if *graphql {
+		*method = "POST"
+		envelope, err := build_graphql_request(string(body_bytes), gql_vars, *gql_op)
+		if err != nil {
+			fmt.Printf("Invalid GraphQL request: %s\n", err)
+			os.Exit(1)
+		}
+		body_bytes = envelope
+		headers["Content-Type"] = "application/json"
+	}
+
+	if *k8s_in_cluster || *kubeconfig != "" {
+		var k8s_cfg K8sConfig
+		var k8s_err error
+		if *kubeconfig != "" {
+			k8s_cfg, k8s_err = configure_from_kubeconfig(*kubeconfig, *k8s_context)
+		} else {
+			k8s_cfg, k8s_err = configure_in_cluster()
+		}
+		if k8s_err != nil {
+			fmt.Printf("Cannot configure Kubernetes client: %s\n", k8s_err)
+			os.Exit(1)
+		}
+
+		if k8s_cfg.TLSConfig != nil {
+			client.Transport = &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: k8s_cfg.TLSConfig,
+			}
+		}
+		if k8s_cfg.BearerToken != "" {
+			headers["Authorization"] = "Bearer " + k8s_cfg.BearerToken
+		}
+		if !strings.HasPrefix(target_url, "http://") && !strings.HasPrefix(target_url, "https://") {
+			target_url = strings.TrimSuffix(k8s_cfg.BaseURL, "/") + "/" + strings.TrimPrefix(target_url, "/")
+		}
+	}
+
+	dump_cfg, err := parse_dump_config(*dump, *dump_indent, *dump_redact, *follow)
+	if err != nil {
+		fmt.Printf("Invalid dump configuration: %s\n", err)
+		os.Exit(1)
+	}
+
+	resp, err := do_with_retry(client, *method, target_url, body_bytes, headers, retry_cfg, dump_cfg)
 	if err != nil {
 		fmt.Printf("Cannot execute command request: %s\n", err)
 		os.Exit(1)
 	}
 
+	if *graphql {
+		handle_graphql_resp(resp, err_map)
+		return
+	}
+
+	if *follow {
+		mapping, matched := resolve_mapping(resp.StatusCode, err_map)
+		is_error_status := resp.StatusCode < 200 || resp.StatusCode >= 300
+		default_message := ""
+		if is_error_status {
+			default_message = resp.Status
+		}
+		run_follow(resp, mapping, default_message, !matched && is_error_status, *follow_exit_on, *follow_heartbeat)
+		return
+	}
+
 	status_code_str := fmt.Sprintf("%d", resp.StatusCode)
 	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
 		m1, ok := err_map[status_code_str]
@@ -155,6 +319,496 @@ func main() {
 	}
 }
 
+type RetryConfig struct {
+	max      int
+	wait_min time.Duration
+	wait_max time.Duration
+	timeout  time.Duration
+	codes    map[int]bool
+	classes  map[string]bool
+}
+
+func parse_retry_config(max int, wait_min time.Duration, wait_max time.Duration, retry_on string, timeout time.Duration) (RetryConfig, error) {
+	cfg := RetryConfig{
+		max:      max,
+		wait_min: wait_min,
+		wait_max: wait_max,
+		timeout:  timeout,
+		codes:    make(map[int]bool),
+		classes:  make(map[string]bool),
+	}
+
+	if retry_on == "" {
+		return cfg, nil
+	}
+
+	for _, entry := range strings.Split(retry_on, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if entry == "2XX" || entry == "4XX" || entry == "5XX" {
+			cfg.classes[entry] = true
+		} else {
+			code, err := strconv.Atoi(entry)
+			if err != nil {
+				return cfg, fmt.Errorf("Invalid retry-on entry: %s", entry)
+			}
+			cfg.codes[code] = true
+		}
+	}
+	return cfg, nil
+}
+
+func (cfg *RetryConfig) is_retryable(status_code int) bool {
+	if cfg.codes[status_code] {
+		return true
+	}
+	class := fmt.Sprintf("%dXX", status_code/100)
+	return cfg.classes[class]
+}
+
+// do_with_retry executes the request, retrying on network errors and on
+// status codes matched by cfg, with exponential backoff and jitter between
+// attempts. body_bytes is re-wrapped into a fresh reader on every attempt so
+// that @file/stdin bodies can be safely resent.
+func do_with_retry(client *http.Client, method string, target_url string, body_bytes []byte, headers map[string]string, cfg RetryConfig, dump_cfg DumpConfig) (*http.Response, error) {
+	var deadline time.Time
+	if cfg.timeout > 0 {
+		deadline = time.Now().Add(cfg.timeout)
+	}
+
+	var resp *http.Response
+	var err error
+
+	for attempt := 0; ; attempt++ {
+		var body_reader io.Reader = nil
+		if body_bytes != nil {
+			body_reader = bytes.NewReader(body_bytes)
+		}
+
+		req, req_err := http.NewRequest(method, target_url, body_reader)
+		if req_err != nil {
+			return nil, req_err
+		}
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+
+		dump_request(req, body_bytes, dump_cfg)
+		resp, err = client.Do(req)
+		if err == nil {
+			dump_response(resp, dump_cfg)
+		}
+
+		retry := false
+		var wait time.Duration
+
+		if err != nil {
+			retry = true
+		} else if cfg.is_retryable(resp.StatusCode) {
+			retry = true
+			if ra := resp.Header.Get("Retry-After"); ra != "" {
+				wait = parse_retry_after(ra)
+			}
+		}
+
+		if !retry || attempt >= cfg.max {
+			return resp, err
+		}
+
+		if wait == 0 {
+			wait = backoff_with_jitter(attempt, cfg.wait_min, cfg.wait_max)
+		}
+
+		if !deadline.IsZero() && time.Now().Add(wait).After(deadline) {
+			return resp, err
+		}
+
+		// Only close the body once we know we're actually retrying;
+		// the caller still needs to read it on the terminal attempt.
+		// After a network error there is no response to close.
+		if resp != nil {
+			resp.Body.Close()
+		}
+
+		log.Debugf("Retrying %s %s (attempt %d) after %s", method, target_url, attempt+1, wait)
+		time.Sleep(wait)
+	}
+}
+
+func parse_retry_after(value string) time.Duration {
+	if seconds, err := strconv.Atoi(strings.TrimSpace(value)); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+func backoff_with_jitter(attempt int, wait_min time.Duration, wait_max time.Duration) time.Duration {
+	wait := wait_min << uint(attempt)
+	if wait <= 0 || wait > wait_max {
+		wait = wait_max
+	}
+	return wait/2 + time.Duration(rand.Int63n(int64(wait/2+1)))
+}
+
+// DumpConfig controls the -dump request/response debug output.
+type DumpConfig struct {
+	mode   string
+	indent string
+	redact map[string]bool
+	follow bool
+}
+
+func parse_dump_config(mode string, indent int, redact string, follow bool) (DumpConfig, error) {
+	switch mode {
+	case "none", "headers", "body", "all":
+	default:
+		return DumpConfig{}, fmt.Errorf("Invalid -dump mode: %s", mode)
+	}
+
+	if indent < 0 {
+		return DumpConfig{}, fmt.Errorf("Invalid -dump-indent: %d", indent)
+	}
+
+	redact_set := make(map[string]bool)
+	for _, h := range strings.Split(redact, ",") {
+		h = strings.TrimSpace(h)
+		if h != "" {
+			redact_set[http.CanonicalHeaderKey(h)] = true
+		}
+	}
+
+	return DumpConfig{mode: mode, indent: strings.Repeat(" ", indent), redact: redact_set, follow: follow}, nil
+}
+
+func (c DumpConfig) enabled() bool      { return c.mode != "none" }
+func (c DumpConfig) dump_headers() bool { return c.mode == "headers" || c.mode == "all" }
+func (c DumpConfig) dump_body() bool    { return c.mode == "body" || c.mode == "all" }
+
+// dump_request prints the outgoing request line, headers and body to
+// stderr. body_bytes is the buffered request body (see do_with_retry),
+// so printing it never consumes the reader that is about to be sent.
+func dump_request(req *http.Request, body_bytes []byte, cfg DumpConfig) {
+	if !cfg.enabled() {
+		return
+	}
+
+	fmt.Fprintf(os.Stderr, "> %s %s\n", req.Method, req.URL.String())
+	if cfg.dump_headers() {
+		for name, values := range req.Header {
+			for _, v := range values {
+				fmt.Fprintf(os.Stderr, "> %s: %s\n", name, redact_header(name, v, cfg.redact))
+			}
+		}
+	}
+	if cfg.dump_body() && len(body_bytes) > 0 {
+		fmt.Fprintln(os.Stderr, ">")
+		fmt.Fprintln(os.Stderr, format_dump_body(req.Header.Get("Content-Type"), body_bytes, cfg.indent))
+	}
+}
+
+// dump_response prints the response status, headers and body to stderr.
+// It tees the body: resp.Body is replaced with a fresh reader over the
+// same bytes so handle_resp/run_follow still see the full payload.
+func dump_response(resp *http.Response, cfg DumpConfig) {
+	if !cfg.enabled() {
+		return
+	}
+
+	fmt.Fprintf(os.Stderr, "< %s\n", resp.Status)
+	if cfg.dump_headers() {
+		for name, values := range resp.Header {
+			for _, v := range values {
+				fmt.Fprintf(os.Stderr, "< %s: %s\n", name, redact_header(name, v, cfg.redact))
+			}
+		}
+	}
+	if cfg.dump_body() {
+		if cfg.follow {
+			// -follow reads resp.Body incrementally as it arrives; buffering
+			// it whole here would block until the stream closes, defeating
+			// streaming (and hanging on streams that never close).
+			fmt.Fprintln(os.Stderr, "< (body omitted: -follow streams it incrementally)")
+			return
+		}
+
+		data, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "< (cannot read body: %s)\n", err)
+			resp.Body = ioutil.NopCloser(bytes.NewReader(nil))
+			return
+		}
+		fmt.Fprintln(os.Stderr, "<")
+		fmt.Fprintln(os.Stderr, format_dump_body(resp.Header.Get("Content-Type"), data, cfg.indent))
+		resp.Body = ioutil.NopCloser(bytes.NewReader(data))
+	}
+}
+
+func redact_header(name string, value string, redact map[string]bool) string {
+	if redact[http.CanonicalHeaderKey(name)] {
+		return "REDACTED"
+	}
+	return value
+}
+
+func format_dump_body(content_type string, data []byte, indent string) string {
+	if strings.HasPrefix(content_type, "application/json") {
+		var out bytes.Buffer
+		if err := json.Indent(&out, data, "", indent); err == nil {
+			return out.String()
+		}
+	}
+	return string(data)
+}
+
+// K8sConfig holds the resolved API server URL and credentials needed to
+// talk to a Kubernetes API server, whether derived from the in-cluster
+// service account or from a kubeconfig file.
+type K8sConfig struct {
+	BaseURL     string
+	BearerToken string
+	TLSConfig   *tls.Config
+}
+
+const service_account_dir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+func configure_in_cluster() (K8sConfig, error) {
+	host := os.Getenv("KUBERNETES_SERVICE_HOST")
+	port := os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return K8sConfig{}, fmt.Errorf("KUBERNETES_SERVICE_HOST/PORT not set; not running in a pod")
+	}
+
+	token, err := ioutil.ReadFile(filepath.Join(service_account_dir, "token"))
+	if err != nil {
+		return K8sConfig{}, fmt.Errorf("Cannot read service account token: %s", err)
+	}
+
+	ca, err := ioutil.ReadFile(filepath.Join(service_account_dir, "ca.crt"))
+	if err != nil {
+		return K8sConfig{}, fmt.Errorf("Cannot read service account CA bundle: %s", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return K8sConfig{}, fmt.Errorf("Cannot parse service account CA bundle")
+	}
+
+	return K8sConfig{
+		BaseURL:     "https://" + host + ":" + port,
+		BearerToken: strings.TrimSpace(string(token)),
+		TLSConfig:   &tls.Config{RootCAs: pool},
+	}, nil
+}
+
+type KubeConfig struct {
+	CurrentContext string          `yaml:"current-context"`
+	Clusters       []NamedCluster  `yaml:"clusters"`
+	Contexts       []NamedContext  `yaml:"contexts"`
+	Users          []NamedAuthInfo `yaml:"users"`
+}
+
+type NamedCluster struct {
+	Name    string      `yaml:"name"`
+	Cluster KubeCluster `yaml:"cluster"`
+}
+
+type KubeCluster struct {
+	Server                   string `yaml:"server"`
+	CertificateAuthority     string `yaml:"certificate-authority"`
+	CertificateAuthorityData string `yaml:"certificate-authority-data"`
+	InsecureSkipTLSVerify    bool   `yaml:"insecure-skip-tls-verify"`
+}
+
+type NamedContext struct {
+	Name    string      `yaml:"name"`
+	Context KubeContext `yaml:"context"`
+}
+
+type KubeContext struct {
+	Cluster string `yaml:"cluster"`
+	User    string `yaml:"user"`
+}
+
+type NamedAuthInfo struct {
+	Name string       `yaml:"name"`
+	User KubeAuthInfo `yaml:"user"`
+}
+
+type KubeAuthInfo struct {
+	Token                 string          `yaml:"token"`
+	ClientCertificate     string          `yaml:"client-certificate"`
+	ClientCertificateData string          `yaml:"client-certificate-data"`
+	ClientKey             string          `yaml:"client-key"`
+	ClientKeyData         string          `yaml:"client-key-data"`
+	Exec                  *KubeExecConfig `yaml:"exec"`
+}
+
+type KubeExecConfig struct {
+	Command string           `yaml:"command"`
+	Args    []string         `yaml:"args"`
+	Env     []KubeExecEnvVar `yaml:"env"`
+}
+
+type KubeExecEnvVar struct {
+	Name  string `yaml:"name"`
+	Value string `yaml:"value"`
+}
+
+type ExecCredential struct {
+	Status struct {
+		Token                 string `json:"token"`
+		ClientCertificateData string `json:"clientCertificateData"`
+		ClientKeyData         string `json:"clientKeyData"`
+	} `json:"status"`
+}
+
+func configure_from_kubeconfig(path string, context_name string) (K8sConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return K8sConfig{}, fmt.Errorf("Cannot read kubeconfig %s: %s", path, err)
+	}
+
+	var kc KubeConfig
+	if err := yaml.Unmarshal(data, &kc); err != nil {
+		return K8sConfig{}, fmt.Errorf("Cannot parse kubeconfig %s: %s", path, err)
+	}
+
+	if context_name == "" {
+		context_name = kc.CurrentContext
+	}
+	if context_name == "" {
+		return K8sConfig{}, fmt.Errorf("No context specified and no current-context set in %s", path)
+	}
+
+	var ctx *KubeContext
+	for i := range kc.Contexts {
+		if kc.Contexts[i].Name == context_name {
+			ctx = &kc.Contexts[i].Context
+			break
+		}
+	}
+	if ctx == nil {
+		return K8sConfig{}, fmt.Errorf("Context %s not found in %s", context_name, path)
+	}
+
+	var cluster *KubeCluster
+	for i := range kc.Clusters {
+		if kc.Clusters[i].Name == ctx.Cluster {
+			cluster = &kc.Clusters[i].Cluster
+			break
+		}
+	}
+	if cluster == nil {
+		return K8sConfig{}, fmt.Errorf("Cluster %s not found in %s", ctx.Cluster, path)
+	}
+
+	var user *KubeAuthInfo
+	for i := range kc.Users {
+		if kc.Users[i].Name == ctx.User {
+			user = &kc.Users[i].User
+			break
+		}
+	}
+
+	result := K8sConfig{BaseURL: cluster.Server}
+
+	tls_config := &tls.Config{InsecureSkipVerify: cluster.InsecureSkipTLSVerify}
+
+	ca, err := read_pem_config(cluster.CertificateAuthorityData, cluster.CertificateAuthority, filepath.Dir(path))
+	if err != nil {
+		return K8sConfig{}, fmt.Errorf("Cannot load cluster CA: %s", err)
+	}
+	if ca != nil {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return K8sConfig{}, fmt.Errorf("Cannot parse cluster CA bundle")
+		}
+		tls_config.RootCAs = pool
+	}
+
+	if user != nil {
+		if user.Exec != nil {
+			token, cert, key, err := run_exec_plugin(user.Exec)
+			if err != nil {
+				return K8sConfig{}, fmt.Errorf("Cannot run exec credential plugin: %s", err)
+			}
+			result.BearerToken = token
+			if cert != nil && key != nil {
+				pair, err := tls.X509KeyPair(cert, key)
+				if err != nil {
+					return K8sConfig{}, fmt.Errorf("Cannot load exec plugin client certificate: %s", err)
+				}
+				tls_config.Certificates = []tls.Certificate{pair}
+			}
+		} else if user.Token != "" {
+			result.BearerToken = user.Token
+		} else if user.ClientCertificateData != "" || user.ClientCertificate != "" {
+			cert, err := read_pem_config(user.ClientCertificateData, user.ClientCertificate, filepath.Dir(path))
+			if err != nil {
+				return K8sConfig{}, fmt.Errorf("Cannot load client certificate: %s", err)
+			}
+			key, err := read_pem_config(user.ClientKeyData, user.ClientKey, filepath.Dir(path))
+			if err != nil {
+				return K8sConfig{}, fmt.Errorf("Cannot load client key: %s", err)
+			}
+			pair, err := tls.X509KeyPair(cert, key)
+			if err != nil {
+				return K8sConfig{}, fmt.Errorf("Cannot load client key pair: %s", err)
+			}
+			tls_config.Certificates = []tls.Certificate{pair}
+		}
+	}
+
+	result.TLSConfig = tls_config
+	return result, nil
+}
+
+// read_pem_config returns PEM data from either a base64-encoded inline
+// value or a file path relative to the kubeconfig's directory.
+func read_pem_config(inline_data string, path string, base_dir string) ([]byte, error) {
+	if inline_data != "" {
+		return base64.StdEncoding.DecodeString(inline_data)
+	}
+	if path == "" {
+		return nil, nil
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(base_dir, path)
+	}
+	return ioutil.ReadFile(path)
+}
+
+func run_exec_plugin(cfg *KubeExecConfig) (token string, cert []byte, key []byte, err error) {
+	cmd := exec.Command(cfg.Command, cfg.Args...)
+	cmd.Env = os.Environ()
+	for _, e := range cfg.Env {
+		cmd.Env = append(cmd.Env, e.Name+"="+e.Value)
+	}
+
+	out, err := cmd.Output()
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	var cred ExecCredential
+	if err := json.Unmarshal(out, &cred); err != nil {
+		return "", nil, nil, fmt.Errorf("Cannot parse exec credential output: %s", err)
+	}
+
+	if cred.Status.ClientCertificateData != "" && cred.Status.ClientKeyData != "" {
+		return cred.Status.Token, []byte(cred.Status.ClientCertificateData), []byte(cred.Status.ClientKeyData), nil
+	}
+	return cred.Status.Token, nil, nil, nil
+}
+
 func handle_resp(m ErrorMapping, resp *http.Response, default_message string) {
 	var message string = default_message
 
@@ -184,6 +838,229 @@ type ErrorMapping struct {
 	template  *jsonpath.JSONPath
 }
 
+// resolve_mapping looks up the ErrorMapping for a status code the same way
+// the non-follow code path does: an exact code match first, falling back
+// to its `2XX`/`4XX`/`5XX` class.
+func resolve_mapping(status_code int, err_map map[string]ErrorMapping) (ErrorMapping, bool) {
+	if m, ok := err_map[fmt.Sprintf("%d", status_code)]; ok {
+		return m, true
+	}
+	if m, ok := err_map[fmt.Sprintf("%dXX", status_code/100)]; ok {
+		return m, true
+	}
+	return ErrorMapping{}, false
+}
+
+// build_graphql_request builds the `{query, variables, operationName}`
+// envelope POSTed by -graphql. Each -gql-var is `name=value`; value is
+// parsed as JSON when possible, otherwise sent as a plain string.
+func build_graphql_request(query string, vars []string, op_name string) ([]byte, error) {
+	variables := make(map[string]interface{})
+	for _, kv := range vars {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Invalid -gql-var: %s", kv)
+		}
+
+		var value interface{}
+		if err := json.Unmarshal([]byte(parts[1]), &value); err != nil {
+			value = parts[1]
+		}
+		variables[parts[0]] = value
+	}
+
+	envelope := map[string]interface{}{"query": query}
+	if len(variables) > 0 {
+		envelope["variables"] = variables
+	}
+	if op_name != "" {
+		envelope["operationName"] = op_name
+	}
+	return json.Marshal(envelope)
+}
+
+// handle_graphql_resp classifies a GraphQL response: a non-empty top-level
+// errors[] is a failure even on HTTP 200. Mappings are looked up by exact
+// status code first, then `GQL` when the envelope carries errors, and only
+// when it carries none, the usual 2XX/4XX/5XX class; {jsonpath} templates
+// resolve against the full
+// envelope, so both `{.errors[0].message}` and `{.data.foo.id}` work.
+func handle_graphql_resp(resp *http.Response, err_map map[string]ErrorMapping) {
+	data, err := decode_json_body(resp)
+	if err != nil {
+		log.Fatalf("Cannot process JSON response: %s", err)
+	}
+
+	has_errors := graphql_has_errors(data)
+
+	mapping, matched := err_map[fmt.Sprintf("%d", resp.StatusCode)]
+	if !matched && has_errors {
+		mapping, matched = err_map["GQL"]
+	}
+	if !matched && !has_errors {
+		// Only fall back to the 2XX/4XX/5XX class when there are no
+		// GraphQL errors to account for; a generic 2XX mapping must not
+		// mask a non-empty errors[] on an HTTP 200.
+		mapping, matched = resolve_mapping(resp.StatusCode, err_map)
+	}
+
+	if !matched {
+		if has_errors || resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			fmt.Fprintf(os.Stderr, "Unexpected response: %d %s\n", resp.StatusCode, resp.Status)
+			os.Exit(1)
+		}
+		return
+	}
+
+	message := ""
+	if has_errors || resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		message = resp.Status
+	}
+	if mapping.template != nil {
+		var b bytes.Buffer
+		if err := mapping.template.Execute(&b, &data); err == nil {
+			message = b.String()
+		}
+	}
+
+	fmt.Printf("%s\n", message)
+	os.Exit(mapping.exit_code)
+}
+
+func graphql_has_errors(data interface{}) bool {
+	envelope, ok := data.(map[string]interface{})
+	if !ok {
+		return false
+	}
+	errs, ok := envelope["errors"].([]interface{})
+	return ok && len(errs) > 0
+}
+
+func decode_json_body(resp *http.Response) (interface{}, error) {
+	var data interface{}
+	decoder := json.NewDecoder(resp.Body)
+	err := decoder.Decode(&data)
+	return data, err
+}
+
+// run_follow streams resp's body one NDJSON object or text line at a time,
+// mapping each record through m's template and printing the result,
+// mirroring the poll loop used by log-tailing clients. It terminates early
+// with m's exit code once follow_exit_on's predicate matches a record. If
+// the stream ends without a match and unmapped_error is set (an error
+// status with no -r mapping), it exits non-zero instead of the implicit
+// success exit code 0, keeping the same exit-code contract as the
+// non-follow code path.
+func run_follow(resp *http.Response, m ErrorMapping, default_message string, unmapped_error bool, follow_exit_on string, heartbeat time.Duration) {
+	exit_path, exit_value := parse_follow_exit_on(follow_exit_on)
+
+	lines := make(chan string)
+	done := make(chan error, 1)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		done <- scanner.Err()
+		close(lines)
+	}()
+
+	var heartbeat_ch <-chan time.Time
+	var ticker *time.Ticker
+	if heartbeat > 0 {
+		ticker = time.NewTicker(heartbeat)
+		defer ticker.Stop()
+		heartbeat_ch = ticker.C
+	}
+
+	for {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				finish_follow(resp, unmapped_error)
+				return
+			}
+			if ticker != nil {
+				ticker.Reset(heartbeat)
+			}
+			if exit_code, matched := process_follow_record(line, m, default_message, exit_path, exit_value); matched {
+				os.Exit(exit_code)
+			}
+		case <-heartbeat_ch:
+			log.Debugf("follow: no data received, still waiting")
+		case err := <-done:
+			if err != nil {
+				fmt.Printf("Error reading stream: %s\n", err)
+				os.Exit(1)
+			}
+			finish_follow(resp, unmapped_error)
+			return
+		}
+	}
+}
+
+// finish_follow is called once a stream ends without follow_exit_on ever
+// matching. An unmapped error status must not fall through to the
+// implicit success exit code 0.
+func finish_follow(resp *http.Response, unmapped_error bool) {
+	if unmapped_error {
+		fmt.Fprintf(os.Stderr, "Unexpected response: %d %s\n", resp.StatusCode, resp.Status)
+		os.Exit(1)
+	}
+}
+
+// process_follow_record maps a single streamed record through m's template
+// and prints it. It returns the exit code to terminate with and true when
+// exit_path/exit_value matched the record.
+func process_follow_record(line string, m ErrorMapping, default_message string, exit_path *jsonpath.JSONPath, exit_value string) (int, bool) {
+	message := line
+
+	var data interface{}
+	if err := json.Unmarshal([]byte(line), &data); err == nil {
+		if m.template != nil {
+			var b bytes.Buffer
+			if err := m.template.Execute(&b, &data); err == nil {
+				message = b.String()
+			} else {
+				message = default_message
+			}
+		}
+
+		if exit_path != nil {
+			var b bytes.Buffer
+			if err := exit_path.Execute(&b, &data); err == nil && b.String() == exit_value {
+				fmt.Printf("%s\n", message)
+				return m.exit_code, true
+			}
+		}
+	}
+
+	fmt.Printf("%s\n", message)
+	return 0, false
+}
+
+func parse_follow_exit_on(expr string) (*jsonpath.JSONPath, string) {
+	if expr == "" {
+		return nil, ""
+	}
+
+	parts := strings.SplitN(expr, "==", 2)
+	if len(parts) != 2 {
+		log.Errorf("Invalid -follow-exit-on predicate: %s", expr)
+		return nil, ""
+	}
+
+	path_expr := strings.TrimSpace(parts[0])
+	value := strings.TrimSpace(parts[1])
+
+	jp := jsonpath.New("follow_exit_on")
+	if err := jp.Parse(path_expr); err != nil {
+		log.Errorf("Cannot parse -follow-exit-on jsonpath %s: %s", path_expr, err)
+		return nil, ""
+	}
+	return jp, value
+}
+
 func parse_error_map(err_map string) (map[string]ErrorMapping, error) {
 	result := make(map[string]ErrorMapping)
 
@@ -203,6 +1080,8 @@ func parse_error_map(err_map string) (map[string]ErrorMapping, error) {
 
 			} else if code == "5XX" {
 
+			} else if code == "GQL" {
+
 			} else {
 				if _, err := strconv.Atoi(code); err != nil {
 					return nil, fmt.Errorf("Invalid HTTP code: %s", code)
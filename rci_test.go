@@ -0,0 +1,343 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"k8s.io/kubernetes/pkg/util/jsonpath"
+)
+
+func TestParseDumpConfig(t *testing.T) {
+	cfg, err := parse_dump_config("all", 2, "Authorization, X-Api-Key", true)
+	if err != nil {
+		t.Fatalf("parse_dump_config returned error: %s", err)
+	}
+	if !cfg.enabled() || !cfg.dump_headers() || !cfg.dump_body() {
+		t.Errorf("expected mode %q to enable headers and body dumping", cfg.mode)
+	}
+	if cfg.indent != "  " {
+		t.Errorf("indent = %q, want 2 spaces", cfg.indent)
+	}
+	if !cfg.redact["Authorization"] || !cfg.redact["X-Api-Key"] {
+		t.Errorf("expected Authorization and X-Api-Key to be redacted, got %v", cfg.redact)
+	}
+	if !cfg.follow {
+		t.Error("expected follow to be threaded through from the argument")
+	}
+}
+
+func TestParseDumpConfigInvalidMode(t *testing.T) {
+	if _, err := parse_dump_config("bogus", 0, "", false); err == nil {
+		t.Error("expected error for invalid -dump mode, got nil")
+	}
+}
+
+func TestParseDumpConfigNegativeIndent(t *testing.T) {
+	if _, err := parse_dump_config("body", -1, "", false); err == nil {
+		t.Error("expected error for negative -dump-indent, got nil")
+	}
+}
+
+func TestRedactHeader(t *testing.T) {
+	redact := map[string]bool{"Authorization": true}
+	if got := redact_header("Authorization", "Bearer secret", redact); got != "REDACTED" {
+		t.Errorf("redact_header(Authorization) = %q, want REDACTED", got)
+	}
+	if got := redact_header("X-Request-Id", "abc123", redact); got != "abc123" {
+		t.Errorf("redact_header(X-Request-Id) = %q, want unchanged", got)
+	}
+}
+
+func TestFormatDumpBodyJSON(t *testing.T) {
+	got := format_dump_body("application/json; charset=utf-8", []byte(`{"a":1}`), "  ")
+	want := "{\n  \"a\": 1\n}"
+	if got != want {
+		t.Errorf("format_dump_body(json) = %q, want %q", got, want)
+	}
+}
+
+func TestFormatDumpBodyNonJSON(t *testing.T) {
+	if got := format_dump_body("text/plain", []byte("hello"), "  "); got != "hello" {
+		t.Errorf("format_dump_body(text) = %q, want unchanged", got)
+	}
+}
+
+func TestFormatDumpBodyMalformedJSON(t *testing.T) {
+	data := "{not json"
+	if got := format_dump_body("application/json", []byte(data), "  "); got != data {
+		t.Errorf("format_dump_body(malformed json) = %q, want unchanged input", got)
+	}
+}
+
+func TestBuildGraphQLRequest(t *testing.T) {
+	out, err := build_graphql_request("query { foo }", []string{"id=42", "name=\"bob\""}, "GetFoo")
+	if err != nil {
+		t.Fatalf("build_graphql_request returned error: %s", err)
+	}
+
+	var envelope map[string]interface{}
+	if err := json.Unmarshal(out, &envelope); err != nil {
+		t.Fatalf("output is not valid JSON: %s", err)
+	}
+	if envelope["query"] != "query { foo }" {
+		t.Errorf("query = %v, want %q", envelope["query"], "query { foo }")
+	}
+	if envelope["operationName"] != "GetFoo" {
+		t.Errorf("operationName = %v, want %q", envelope["operationName"], "GetFoo")
+	}
+	vars, ok := envelope["variables"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("variables = %v, want a map", envelope["variables"])
+	}
+	if vars["id"] != float64(42) {
+		t.Errorf("variables[id] = %v, want 42 (parsed as JSON)", vars["id"])
+	}
+	if vars["name"] != "bob" {
+		t.Errorf("variables[name] = %v, want %q", vars["name"], "bob")
+	}
+}
+
+func TestBuildGraphQLRequestNonJSONValueFallsBackToString(t *testing.T) {
+	out, err := build_graphql_request("query { foo }", []string{"name=bob"}, "")
+	if err != nil {
+		t.Fatalf("build_graphql_request returned error: %s", err)
+	}
+	var envelope map[string]interface{}
+	if err := json.Unmarshal(out, &envelope); err != nil {
+		t.Fatalf("output is not valid JSON: %s", err)
+	}
+	vars := envelope["variables"].(map[string]interface{})
+	if vars["name"] != "bob" {
+		t.Errorf("variables[name] = %v, want the raw string %q", vars["name"], "bob")
+	}
+}
+
+func TestBuildGraphQLRequestInvalidVar(t *testing.T) {
+	if _, err := build_graphql_request("query { foo }", []string{"no-equals-sign"}, ""); err == nil {
+		t.Error("expected error for a -gql-var with no '=', got nil")
+	}
+}
+
+func TestGraphQLHasErrors(t *testing.T) {
+	cases := []struct {
+		name string
+		data interface{}
+		want bool
+	}{
+		{"no errors key", map[string]interface{}{"data": map[string]interface{}{}}, false},
+		{"empty errors", map[string]interface{}{"errors": []interface{}{}}, false},
+		{"non-empty errors", map[string]interface{}{"errors": []interface{}{map[string]interface{}{"message": "boom"}}}, true},
+		{"not an object", []interface{}{}, false},
+	}
+	for _, c := range cases {
+		if got := graphql_has_errors(c.data); got != c.want {
+			t.Errorf("%s: graphql_has_errors() = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestParseFollowExitOn(t *testing.T) {
+	jp, value := parse_follow_exit_on("{.status}==done")
+	if jp == nil {
+		t.Fatal("expected a non-nil jsonpath")
+	}
+	if value != "done" {
+		t.Errorf("value = %q, want %q", value, "done")
+	}
+}
+
+func TestParseFollowExitOnEmpty(t *testing.T) {
+	jp, value := parse_follow_exit_on("")
+	if jp != nil || value != "" {
+		t.Errorf("parse_follow_exit_on(\"\") = (%v, %q), want (nil, \"\")", jp, value)
+	}
+}
+
+func TestParseFollowExitOnInvalid(t *testing.T) {
+	if jp, _ := parse_follow_exit_on("no-separator-here"); jp != nil {
+		t.Errorf("expected nil jsonpath for a predicate with no '==', got %v", jp)
+	}
+}
+
+func TestProcessFollowRecordMatchesExit(t *testing.T) {
+	jp := jsonpath.New("exit")
+	if err := jp.Parse("{.status}"); err != nil {
+		t.Fatalf("jp.Parse returned error: %s", err)
+	}
+	m := ErrorMapping{exit_code: 3}
+
+	code, done := process_follow_record(`{"status":"done"}`, m, "default", jp, "done")
+	if !done || code != 3 {
+		t.Errorf("process_follow_record() = (%d, %v), want (3, true)", code, done)
+	}
+}
+
+func TestProcessFollowRecordNoMatch(t *testing.T) {
+	jp := jsonpath.New("exit")
+	if err := jp.Parse("{.status}"); err != nil {
+		t.Fatalf("jp.Parse returned error: %s", err)
+	}
+	m := ErrorMapping{}
+
+	code, done := process_follow_record(`{"status":"running"}`, m, "default", jp, "done")
+	if done || code != 0 {
+		t.Errorf("process_follow_record() = (%d, %v), want (0, false)", code, done)
+	}
+}
+
+func TestProcessFollowRecordNonJSONLine(t *testing.T) {
+	m := ErrorMapping{}
+	code, done := process_follow_record("not json", m, "default", nil, "")
+	if done || code != 0 {
+		t.Errorf("process_follow_record(non-JSON line) = (%d, %v), want (0, false)", code, done)
+	}
+}
+
+func TestReadPemConfigInline(t *testing.T) {
+	want := "pem-bytes"
+	inline := base64.StdEncoding.EncodeToString([]byte(want))
+	got, err := read_pem_config(inline, "ignored.pem", "/ignored")
+	if err != nil {
+		t.Fatalf("read_pem_config returned error: %s", err)
+	}
+	if string(got) != want {
+		t.Errorf("read_pem_config(inline) = %q, want %q", got, want)
+	}
+}
+
+func TestReadPemConfigRelativePath(t *testing.T) {
+	dir := t.TempDir()
+	want := "relative-pem-bytes"
+	if err := ioutil.WriteFile(filepath.Join(dir, "ca.pem"), []byte(want), 0600); err != nil {
+		t.Fatalf("WriteFile: %s", err)
+	}
+
+	got, err := read_pem_config("", "ca.pem", dir)
+	if err != nil {
+		t.Fatalf("read_pem_config returned error: %s", err)
+	}
+	if string(got) != want {
+		t.Errorf("read_pem_config(relative path) = %q, want %q", got, want)
+	}
+}
+
+func TestReadPemConfigAbsolutePath(t *testing.T) {
+	dir := t.TempDir()
+	want := "absolute-pem-bytes"
+	abs := filepath.Join(dir, "ca.pem")
+	if err := ioutil.WriteFile(abs, []byte(want), 0600); err != nil {
+		t.Fatalf("WriteFile: %s", err)
+	}
+
+	got, err := read_pem_config("", abs, "/some/other/dir")
+	if err != nil {
+		t.Fatalf("read_pem_config returned error: %s", err)
+	}
+	if string(got) != want {
+		t.Errorf("read_pem_config(absolute path) = %q, want %q", got, want)
+	}
+}
+
+func TestReadPemConfigNeitherSet(t *testing.T) {
+	got, err := read_pem_config("", "", "/ignored")
+	if err != nil || got != nil {
+		t.Errorf("read_pem_config(none) = (%v, %v), want (nil, nil)", got, err)
+	}
+}
+
+func TestGqlVarList(t *testing.T) {
+	var v gqlVarList
+	if err := v.Set("id=1"); err != nil {
+		t.Fatalf("Set returned error: %s", err)
+	}
+	if err := v.Set("name=bob"); err != nil {
+		t.Fatalf("Set returned error: %s", err)
+	}
+	if got, want := v.String(), "id=1,name=bob"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+}
+
+func TestParseRetryConfig(t *testing.T) {
+	cfg, err := parse_retry_config(3, time.Second, 10*time.Second, "500,2XX, 429", 0)
+	if err != nil {
+		t.Fatalf("parse_retry_config returned error: %s", err)
+	}
+	if !cfg.codes[500] || !cfg.codes[429] {
+		t.Errorf("expected codes 500 and 429 to be set, got %v", cfg.codes)
+	}
+	if !cfg.classes["2XX"] {
+		t.Errorf("expected class 2XX to be set, got %v", cfg.classes)
+	}
+
+	if _, err := parse_retry_config(3, time.Second, 10*time.Second, "not-a-code", 0); err == nil {
+		t.Error("expected error for invalid retry-on entry, got nil")
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	cfg, err := parse_retry_config(3, time.Second, 10*time.Second, "503,4XX", 0)
+	if err != nil {
+		t.Fatalf("parse_retry_config returned error: %s", err)
+	}
+
+	cases := []struct {
+		status int
+		want   bool
+	}{
+		{503, true},
+		{404, true},
+		{200, false},
+		{502, false},
+	}
+	for _, c := range cases {
+		if got := cfg.is_retryable(c.status); got != c.want {
+			t.Errorf("is_retryable(%d) = %v, want %v", c.status, got, c.want)
+		}
+	}
+}
+
+func TestParseRetryAfterSeconds(t *testing.T) {
+	if got, want := parse_retry_after("5"), 5*time.Second; got != want {
+		t.Errorf("parse_retry_after(\"5\") = %s, want %s", got, want)
+	}
+}
+
+func TestParseRetryAfterHTTPDate(t *testing.T) {
+	future := time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)
+	got := parse_retry_after(future)
+	if got <= 0 || got > time.Hour {
+		t.Errorf("parse_retry_after(%q) = %s, want a positive duration close to 1h", future, got)
+	}
+}
+
+func TestParseRetryAfterInvalid(t *testing.T) {
+	if got := parse_retry_after("garbage"); got != 0 {
+		t.Errorf("parse_retry_after(\"garbage\") = %s, want 0", got)
+	}
+}
+
+func TestBackoffWithJitterBounds(t *testing.T) {
+	wait_min := 100 * time.Millisecond
+	wait_max := time.Second
+	for attempt := 0; attempt < 6; attempt++ {
+		got := backoff_with_jitter(attempt, wait_min, wait_max)
+		if got < 0 || got > wait_max {
+			t.Errorf("backoff_with_jitter(%d, ...) = %s, want in [0, %s]", attempt, got, wait_max)
+		}
+	}
+}
+
+func TestBackoffWithJitterCapsAtMax(t *testing.T) {
+	// A large attempt overflows wait_min<<attempt into a non-positive
+	// duration; it must fall back to wait_max rather than go negative.
+	got := backoff_with_jitter(100, time.Second, 5*time.Second)
+	if got < 0 || got > 5*time.Second {
+		t.Errorf("backoff_with_jitter(100, ...) = %s, want in [0, 5s]", got)
+	}
+}